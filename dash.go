@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// PackagingFormat builds the format-specific tail of an ffmpeg command line
+// (muxer, segmenting options and output path) on top of the shared
+// scale/map/codec arguments every rendition ladder produces.
+type PackagingFormat interface {
+	// Name identifies the format.
+	Name() string
+	// OutputArgs returns the ffmpeg arguments that turn the mapped streams
+	// into this format's segments/manifest inside outputDir, for the given
+	// video ladder plus its alternate audio/subtitle tracks.
+	OutputArgs(outputDir string, ladder []variantSpec, audioTracks, subtitles []TrackInfo) []string
+}
+
+type hlsFormat struct{}
+
+func (hlsFormat) Name() string { return "hls" }
+func (hlsFormat) OutputArgs(outputDir string, ladder []variantSpec, audioTracks, subtitles []TrackInfo) []string {
+	return []string{
+		"-f", "hls",
+		"-hls_time", "5",
+		"-hls_list_size", "0",
+		"-hls_flags", "independent_segments",
+		"-var_stream_map", hlsVarStreamMap(ladder, audioTracks, subtitles),
+		"-master_pl_name", "master.m3u8",
+		"-hls_segment_filename", filepath.Join(outputDir, "stream_%v/chunk%05d.ts"),
+		filepath.Join(outputDir, "stream_%v/stream.m3u8"),
+	}
+}
+
+type dashFormat struct{}
+
+func (dashFormat) Name() string { return "dash" }
+func (dashFormat) OutputArgs(outputDir string, ladder []variantSpec, audioTracks, subtitles []TrackInfo) []string {
+	adaptationSets := "id=0,streams=v"
+	if len(audioTracks) > 0 {
+		adaptationSets += " id=1,streams=a"
+	}
+	return []string{
+		"-f", "dash",
+		"-seg_duration", "5",
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-stream$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-stream$RepresentationID$-$Number%05d$.m4s",
+		filepath.Join(outputDir, "manifest.mpd"),
+	}
+}
+
+var packagingFormats = map[string]PackagingFormat{
+	"hls":  hlsFormat{},
+	"dash": dashFormat{},
+}
+
+// formatsFor expands a ?format= value into the list of packaging formats
+// transcode() should produce. "hls" is rejected: /hls/ is served on demand
+// straight from videos/ (see handleHLS), so a queued eager hlsFormat job
+// would only write a transcoded/ tree nothing ever reads. "both" drops to
+// just DASH for the same reason.
+func formatsFor(name string) ([]PackagingFormat, error) {
+	switch name {
+	case "":
+		return []PackagingFormat{dashFormat{}}, nil
+	case "hls":
+		return nil, fmt.Errorf("format %q is served on demand at /hls/<video>/master.m3u8 and cannot be queued", name)
+	case "dash":
+		return []PackagingFormat{dashFormat{}}, nil
+	case "both":
+		return []PackagingFormat{dashFormat{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", name)
+	}
+}
+
+// dashURL returns the manifest URL for a completed mapping that included
+// DASH output, or "" otherwise.
+func dashURL(m *VideoMapping) string {
+	if m.Status != "completed" || (m.Format != "dash" && m.Format != "both") {
+		return ""
+	}
+	return fmt.Sprintf("/dash/%s/manifest.mpd", m.TranscodeDir)
+}
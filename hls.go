@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionIdleTimeout is how long an idle ffmpeg session is kept alive before
+// being killed to free CPU and disk.
+const sessionIdleTimeout = 60 * time.Second
+
+// hlsSegmentSeconds is the target duration of each HLS segment, used both as
+// ffmpeg's -hls_time and to translate a requested segment number into a seek
+// offset when a session has to be started mid-stream.
+const hlsSegmentSeconds = 5
+
+// variantSpec describes one rendition of the on-demand HLS ladder.
+type variantSpec struct {
+	Name    string `json:"name"` // e.g. "480p", used in the URL path and variant group
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate string `json:"bitrate"` // ffmpeg -b:v value, e.g. "1500k"
+}
+
+// variantByName finds a rendition by name within a video's per-title
+// ladder (see chooseLadder in ladder.go).
+func variantByName(ladder []variantSpec, name string) (variantSpec, bool) {
+	for _, v := range ladder {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return variantSpec{}, false
+}
+
+// TranscoderProfile selects the ffmpeg video encoder and the extra arguments
+// it needs (hwaccel init, rate control, presets, ...). Implementations cover
+// software x264 plus the hardware backends go-vod/go-transcode support.
+type TranscoderProfile interface {
+	// Name identifies the profile, also accepted via the ?hwaccel= query param.
+	Name() string
+	// GlobalArgs returns ffmpeg arguments that must appear before -i (hwaccel init).
+	GlobalArgs() []string
+	// Codec returns the -c:v value for this profile.
+	Codec() string
+	// EncodeArgs returns additional per-output encoder arguments (preset, rc, ...).
+	EncodeArgs() []string
+	// VideoFilter returns the full -filter:v chain that scales to w/h, so
+	// hardware profiles can splice surface-upload steps around the scale
+	// instead of appending a second, conflicting video-filter option.
+	VideoFilter(w, h int) string
+}
+
+type x264Profile struct{}
+
+func (x264Profile) Name() string         { return "libx264" }
+func (x264Profile) GlobalArgs() []string { return nil }
+func (x264Profile) Codec() string        { return "libx264" }
+func (x264Profile) EncodeArgs() []string { return []string{"-preset", "veryfast"} }
+func (x264Profile) VideoFilter(w, h int) string {
+	return fmt.Sprintf("scale=w=%d:h=%d", w, h)
+}
+
+type nvencProfile struct{}
+
+func (nvencProfile) Name() string         { return "h264_nvenc" }
+func (nvencProfile) GlobalArgs() []string { return []string{"-hwaccel", "cuda"} }
+func (nvencProfile) Codec() string        { return "h264_nvenc" }
+func (nvencProfile) EncodeArgs() []string { return []string{"-preset", "p4"} }
+func (nvencProfile) VideoFilter(w, h int) string {
+	return fmt.Sprintf("scale=w=%d:h=%d", w, h)
+}
+
+type vaapiProfile struct{}
+
+func (vaapiProfile) Name() string { return "h264_vaapi" }
+func (vaapiProfile) GlobalArgs() []string {
+	return []string{"-hwaccel", "vaapi", "-vaapi_device", "/dev/dri/renderD128"}
+}
+func (vaapiProfile) Codec() string        { return "h264_vaapi" }
+func (vaapiProfile) EncodeArgs() []string { return nil }
+
+// VideoFilter uploads the decoded frame to the VAAPI surface and scales
+// there, folding what used to be a separate -vf format=nv12,hwupload into
+// the same chain as the scale: ffmpeg only accepts one -filter:v/-vf per
+// output, and getOrStart already owns that flag for every profile.
+func (vaapiProfile) VideoFilter(w, h int) string {
+	return fmt.Sprintf("format=nv12,hwupload,scale_vaapi=w=%d:h=%d", w, h)
+}
+
+type qsvProfile struct{}
+
+func (qsvProfile) Name() string         { return "h264_qsv" }
+func (qsvProfile) GlobalArgs() []string { return []string{"-hwaccel", "qsv"} }
+func (qsvProfile) Codec() string        { return "h264_qsv" }
+func (qsvProfile) EncodeArgs() []string { return []string{"-preset", "fast"} }
+func (qsvProfile) VideoFilter(w, h int) string {
+	return fmt.Sprintf("scale=w=%d:h=%d", w, h)
+}
+
+var transcoderProfiles = map[string]TranscoderProfile{
+	"libx264":    x264Profile{},
+	"h264_nvenc": nvencProfile{},
+	"h264_vaapi": vaapiProfile{},
+	"h264_qsv":   qsvProfile{},
+}
+
+// defaultHWAccel is the profile used when a request doesn't specify
+// ?hwaccel=, overridable via the TRANSCODE_HWACCEL env var.
+var defaultHWAccel = envOr("TRANSCODE_HWACCEL", "libx264")
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func profileFor(name string) TranscoderProfile {
+	if p, ok := transcoderProfiles[name]; ok {
+		return p
+	}
+	return transcoderProfiles[defaultHWAccel]
+}
+
+// hlsSession is one long-lived ffmpeg process producing HLS segments for a
+// single (video, variant) pair. It is reused across requests until it goes
+// idle for longer than sessionIdleTimeout.
+type hlsSession struct {
+	video        string
+	variant      string
+	dir          string
+	cmd          *exec.Cmd
+	startSegment int // -start_number this session's ffmpeg was launched with
+
+	mu         sync.Mutex
+	lastAccess time.Time
+	stopped    bool
+}
+
+func (s *hlsSession) touch() {
+	s.mu.Lock()
+	s.lastAccess = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *hlsSession) idleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastAccess)
+}
+
+// SessionManager keeps track of the ffmpeg sessions backing the on-demand
+// HLS endpoints, keyed by "<video>/<variant>".
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*hlsSession
+}
+
+func newSessionManager() *SessionManager {
+	m := &SessionManager{sessions: make(map[string]*hlsSession)}
+	go m.reapLoop()
+	return m
+}
+
+func (m *SessionManager) reapLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		for key, s := range m.sessions {
+			if s.idleFor() > sessionIdleTimeout {
+				log.Printf("hls: killing idle session %s", key)
+				s.stop()
+				delete(m.sessions, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (s *hlsSession) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+}
+
+// getOrStart returns the session for video/variant, spawning a new ffmpeg
+// process under the given encoder profile if none is running yet. startSegment
+// is the chunk number the triggering request asked for (0 for the variant
+// playlist itself); a new session seeks to that segment's timestamp instead
+// of always encoding from the start, so a mid-file request doesn't have to
+// wait on a full linear encode to catch up.
+func (m *SessionManager) getOrStart(video, variantName string, profile TranscoderProfile, startSegment int) (*hlsSession, error) {
+	key := video + "/" + variantName
+
+	m.mu.Lock()
+	if s, ok := m.sessions[key]; ok {
+		if startSegment >= s.startSegment {
+			m.mu.Unlock()
+			s.touch()
+			return s, nil
+		}
+		// The running session was seeded from a later segment than this
+		// request needs (e.g. the viewer scrubbed backward); it can never
+		// produce the earlier chunk, so replace it with one seeded further
+		// back instead of 503ing until it's reaped.
+		delete(m.sessions, key)
+		m.mu.Unlock()
+		s.stop()
+	} else {
+		m.mu.Unlock()
+	}
+
+	videoPath := filepath.Join("videos", video)
+	if _, err := os.Stat(videoPath); err != nil {
+		return nil, err
+	}
+
+	info, err := probe(videoPath)
+	if err != nil {
+		return nil, err
+	}
+	variant, ok := variantByName(chooseLadder(info), variantName)
+	if !ok {
+		return nil, fmt.Errorf("unknown variant %q", variantName)
+	}
+
+	outDir := filepath.Join("transcoded", video, variantName)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	seekSeconds := startSegment * hlsSegmentSeconds
+
+	args := append([]string{}, profile.GlobalArgs()...)
+	args = append(args,
+		"-ss", fmt.Sprintf("%d", seekSeconds),
+		"-i", videoPath,
+		"-filter:v", profile.VideoFilter(variant.Width, variant.Height),
+		"-c:v", profile.Codec(),
+		"-b:v", variant.Bitrate,
+		"-g", "60",
+	)
+	args = append(args, profile.EncodeArgs()...)
+	if info.HasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	} else {
+		args = append(args, "-an")
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", fmt.Sprintf("%d", hlsSegmentSeconds),
+		"-hls_list_size", "0",
+		"-hls_flags", "independent_segments",
+		"-start_number", fmt.Sprintf("%d", startSegment),
+		"-hls_segment_filename", filepath.Join(outDir, "chunk%05d.ts"),
+		filepath.Join(outDir, "stream.m3u8"),
+	)
+
+	cmd := exec.Command("ffmpeg", args...)
+	logFile, err := os.Create(filepath.Join(outDir, "ffmpeg.log"))
+	if err == nil {
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	s := &hlsSession{
+		video:        video,
+		variant:      variantName,
+		dir:          outDir,
+		cmd:          cmd,
+		startSegment: startSegment,
+		lastAccess:   time.Now(),
+	}
+
+	go func() {
+		cmd.Wait()
+		if logFile != nil {
+			logFile.Close()
+		}
+	}()
+
+	m.mu.Lock()
+	m.sessions[key] = s
+	m.mu.Unlock()
+
+	log.Printf("hls: started session %s with profile %s", key, profile.Name())
+	return s, nil
+}
+
+var sessionManager = newSessionManager()
+
+// handleHLS serves the virtual master playlist, the per-variant playlists
+// and segments for a video, spawning ffmpeg sessions on demand.
+func handleHLS(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/hls/")
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	video, resource := parts[0], parts[1]
+
+	if resource == "master.m3u8" {
+		serveVirtualMaster(w, video)
+		return
+	}
+
+	if len(parts) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+	variant, file := parts[1], parts[2]
+
+	profileName := r.URL.Query().Get("hwaccel")
+	if profileName == "" {
+		profileName = defaultHWAccel
+	}
+	profile := profileFor(profileName)
+
+	startSegment, _ := parseSegmentIndex(file)
+
+	session, err := sessionManager.getOrStart(video, variant, profile, startSegment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	session.touch()
+
+	path := filepath.Join(session.dir, file)
+	if err := waitForFile(path, 10*time.Second); err != nil {
+		http.Error(w, "segment not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	http.ServeFile(w, r, path)
+}
+
+// parseSegmentIndex extracts the chunk number from a segment filename
+// matching the "chunk%05d.ts" pattern getOrStart writes, so a request for a
+// specific segment can seed a fresh ffmpeg session near that point instead
+// of always starting at 0. ok is false for anything else (e.g. stream.m3u8),
+// which starts a session from the beginning.
+func parseSegmentIndex(file string) (index int, ok bool) {
+	name := strings.TrimSuffix(file, ".ts")
+	name = strings.TrimPrefix(name, "chunk")
+	if name == file {
+		return 0, false
+	}
+	n, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// waitForFile polls for a file's existence, used right after starting an
+// ffmpeg session so the first request for stream.m3u8/chunk00000.ts doesn't
+// 404 before ffmpeg has had a chance to write it.
+func waitForFile(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// serveVirtualMaster writes a master playlist listing every rendition as a
+// variant stream, without transcoding anything up front.
+func serveVirtualMaster(w http.ResponseWriter, video string) {
+	videoPath := filepath.Join("videos", video)
+	if _, err := os.Stat(videoPath); err != nil {
+		http.Error(w, "video not found", http.StatusNotFound)
+		return
+	}
+
+	info, err := probe(videoPath)
+	if err != nil {
+		http.Error(w, "could not analyze video", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, v := range chooseLadder(info) {
+		bw := bitrateToBps(v.Bitrate)
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n", bw, v.Width, v.Height)
+		fmt.Fprintf(w, "%s/stream.m3u8\n", v.Name)
+	}
+}
+
+// bitrateToBps converts a ffmpeg bitrate string like "1500k" to bits/sec.
+func bitrateToBps(b string) int {
+	b = strings.TrimSpace(b)
+	mult := 1
+	if strings.HasSuffix(b, "k") {
+		mult = 1000
+		b = strings.TrimSuffix(b, "k")
+	} else if strings.HasSuffix(b, "M") {
+		mult = 1000000
+		b = strings.TrimSuffix(b, "M")
+	}
+	n := 0
+	fmt.Sscanf(b, "%d", &n)
+	return n * mult
+}
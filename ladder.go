@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MediaInfo is the subset of ffprobe's stream/format analysis the ladder
+// builder needs to pick renditions for a given source file.
+type MediaInfo struct {
+	Width      int
+	Height     int
+	FPS        float64
+	Duration   float64
+	BitRate    int
+	VideoCodec string
+	HasAudio   bool
+	HDR        bool
+
+	// AudioTracks and Subtitles are indexed within their own stream type
+	// (0:a:N / 0:s:N), matching how ffmpeg's -map expects to reference them.
+	AudioTracks []TrackInfo
+	Subtitles   []TrackInfo
+}
+
+type ffprobeStream struct {
+	CodecType     string            `json:"codec_type"`
+	CodecName     string            `json:"codec_name"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	RFrameRate    string            `json:"r_frame_rate"`
+	ColorTransfer string            `json:"color_transfer"`
+	ColorSpace    string            `json:"color_space"`
+	Tags          map[string]string `json:"tags"`
+}
+
+type ffprobeFormat struct {
+	Duration string `json:"duration"`
+	BitRate  string `json:"bit_rate"`
+}
+
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  ffprobeFormat   `json:"format"`
+}
+
+// probe runs ffprobe against videoPath and extracts the dimensions, frame
+// rate, duration and HDR/audio hints the per-title ladder is built from.
+func probe(videoPath string) (*MediaInfo, error) {
+	out, err := exec.Command("ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_streams",
+		"-show_format",
+		videoPath,
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed ffprobeOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return nil, err
+	}
+
+	info := &MediaInfo{}
+	info.Duration, _ = strconv.ParseFloat(parsed.Format.Duration, 64)
+	info.BitRate, _ = strconv.Atoi(parsed.Format.BitRate)
+
+	for _, s := range parsed.Streams {
+		switch s.CodecType {
+		case "video":
+			if info.Width == 0 && info.Height == 0 {
+				info.Width, info.Height = s.Width, s.Height
+				info.VideoCodec = s.CodecName
+				info.FPS = parseFrameRate(s.RFrameRate)
+				info.HDR = isHDRTransfer(s.ColorTransfer) || s.ColorSpace == "bt2020nc"
+			}
+		case "audio":
+			info.HasAudio = true
+			info.AudioTracks = append(info.AudioTracks, TrackInfo{
+				Index:    len(info.AudioTracks),
+				Language: s.Tags["language"],
+			})
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, TrackInfo{
+				Index:    len(info.Subtitles),
+				Language: s.Tags["language"],
+			})
+		}
+	}
+
+	return info, nil
+}
+
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	n, errN := strconv.ParseFloat(num, 64)
+	if !ok {
+		return n
+	}
+	d, errD := strconv.ParseFloat(den, 64)
+	if errN != nil || errD != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+func isHDRTransfer(transfer string) bool {
+	switch transfer {
+	case "smpte2084", "arib-std-b67":
+		return true
+	default:
+		return false
+	}
+}
+
+// rungSpec is one entry of the curated ladder, before it's scaled to a
+// source's aspect ratio, fps and bitrate.
+type rungSpec struct {
+	Name      string
+	Height    int
+	BitrateKb int
+}
+
+var curatedLadder = []rungSpec{
+	{"240p", 240, 400},
+	{"360p", 360, 700},
+	{"480p", 480, 1200},
+	{"720p", 720, 2500},
+	{"1080p", 1080, 4500},
+	{"1440p", 1440, 8000},
+	{"2160p", 2160, 16000},
+}
+
+// chooseLadder builds the per-title rendition ladder from a probed source:
+// it drops curated rungs taller than the source's short side, scales bitrate
+// down for sub-30fps sources, keeps width/height oriented to match vertical
+// video, and falls back to a single 1080p rendition for HDR sources to avoid
+// tone-mapping surprises. For non-HDR sources, when fewer than two rungs fit,
+// it returns the two lowest curated rungs (240p and 360p) so ABR has
+// something to switch between, even where that upscales the source.
+func chooseLadder(info *MediaInfo) []variantSpec {
+	vertical := info.Height > info.Width
+	shortSide, longSide := info.Height, info.Width
+	if vertical {
+		shortSide, longSide = info.Width, info.Height
+	}
+	aspect := 16.0 / 9.0
+	if shortSide > 0 {
+		aspect = float64(longSide) / float64(shortSide)
+	}
+
+	fpsScale := 1.0
+	if info.FPS > 0 && info.FPS < 30 {
+		fpsScale = info.FPS / 30
+	}
+
+	if info.HDR {
+		return []variantSpec{buildRendition(rungSpec{"1080p", 1080, 4500}, aspect, vertical, fpsScale)}
+	}
+
+	var out []variantSpec
+	for _, rung := range curatedLadder {
+		if shortSide > 0 && rung.Height > shortSide {
+			continue
+		}
+		out = append(out, buildRendition(rung, aspect, vertical, fpsScale))
+	}
+
+	if len(out) < 2 {
+		out = nil
+		for _, rung := range curatedLadder[:2] {
+			out = append(out, buildRendition(rung, aspect, vertical, fpsScale))
+		}
+	}
+
+	return out
+}
+
+func buildRendition(rung rungSpec, aspect float64, vertical bool, fpsScale float64) variantSpec {
+	long := int(float64(rung.Height)*aspect+0.5) &^ 1 // round to even
+	width, height := long, rung.Height
+	if vertical {
+		width, height = rung.Height, long
+	}
+
+	bitrate := int(float64(rung.BitrateKb) * fpsScale)
+	if bitrate < 1 {
+		bitrate = 1
+	}
+
+	return variantSpec{
+		Name:    rung.Name,
+		Width:   width,
+		Height:  height,
+		Bitrate: strconv.Itoa(bitrate) + "k",
+	}
+}
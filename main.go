@@ -6,16 +6,20 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 )
 
 type VideoMapping struct {
-	OriginalName string `json:"original_name"`
-	TranscodeDir string `json:"transcode_dir"`
-	Status       string `json:"status"` // "processing", "completed", "failed"
+	OriginalName string        `json:"original_name"`
+	TranscodeDir string        `json:"transcode_dir"`
+	Status       string        `json:"status"`           // "uploaded", "processing", "completed", "failed"
+	Format       string        `json:"format"`           // "dash" ("both" is stored as "dash"); HLS is served on demand, not queued
+	Hash         string        `json:"hash,omitempty"`   // sha256 of the source file, for upload dedupe
+	Ladder       []variantSpec `json:"ladder,omitempty"` // per-title rendition ladder chosen from ffprobe
+	AudioTracks  []TrackInfo   `json:"audio_tracks,omitempty"`
+	Subtitles    []TrackInfo   `json:"subtitles,omitempty"`
 }
 
 type TranscodeState struct {
@@ -42,14 +46,21 @@ func main() {
 	os.MkdirAll("videos", 0755)
 	os.MkdirAll("transcoded", 0755)
 
-	// Serve transcoded files
-	fs := http.FileServer(http.Dir("transcoded"))
-	http.Handle("/hls/", corsHandler(http.StripPrefix("/hls/", fs)))
+	// Serve on-demand HLS: ffmpeg sessions are spawned lazily per
+	// (video, variant) the first time a client asks for it.
+	http.Handle("/hls/", corsHandler(http.HandlerFunc(handleHLS)))
+
+	// Serve DASH manifests/segments produced by the eager /api/transcode pipeline.
+	dashFS := http.FileServer(http.Dir("transcoded"))
+	http.Handle("/dash/", corsHandler(http.StripPrefix("/dash/", dashFS)))
 
 	// API routes
 	http.HandleFunc("/api/videos", handleGetVideos)
+	http.HandleFunc("/api/videos/", handleDeleteVideo)
 	http.HandleFunc("/api/transcode", handleTranscode)
 	http.HandleFunc("/api/status/", handleStatus)
+	http.HandleFunc("/api/upload", handleUpload)
+	http.HandleFunc("/api/admin/upload", requireAdmin(handleUpload))
 
 	// Start server
 	addr := ":8000"
@@ -58,7 +69,9 @@ func main() {
 	log.Println("  GET  /api/videos - List all videos")
 	log.Println("  POST /api/transcode?video=<name> - Transcode a video")
 	log.Println("  GET  /api/status/<video> - Get transcode status")
-	log.Println("  GET  /hls/<dir>/master.m3u8 - Stream transcoded video")
+	log.Println("  GET  /hls/<video>/master.m3u8 - Virtual master playlist")
+	log.Println("  GET  /hls/<video>/<variant>/stream.m3u8 - Variant playlist (starts ffmpeg on demand)")
+	log.Println("  GET  /hls/<video>/<variant>/<segment>.ts?hwaccel=libx264|h264_nvenc|h264_vaapi|h264_qsv - Segment")
 
 	if err := http.ListenAndServe(addr, nil); err != nil {
 		log.Fatal(err)
@@ -77,6 +90,8 @@ func corsHandler(next http.Handler) http.Handler {
 			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 		case ".ts":
 			w.Header().Set("Content-Type", "video/mp2t")
+		case ".mpd":
+			w.Header().Set("Content-Type", "application/dash+xml")
 		}
 
 		if r.Method == http.MethodOptions {
@@ -104,11 +119,15 @@ func handleGetVideos(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type VideoInfo struct {
-		Name         string `json:"name"`
-		Transcoded   bool   `json:"transcoded"`
-		Status       string `json:"status,omitempty"`
-		StreamURL    string `json:"stream_url,omitempty"`
-		TranscodeDir string `json:"transcode_dir,omitempty"`
+		Name         string      `json:"name"`
+		Transcoded   bool        `json:"transcoded"`
+		Status       string      `json:"status,omitempty"`
+		StreamURL    string      `json:"stream_url,omitempty"`
+		DashURL      string      `json:"dash_url,omitempty"`
+		TranscodeDir string      `json:"transcode_dir,omitempty"`
+		Progress     *jobStatus  `json:"progress,omitempty"`
+		AudioTracks  []TrackInfo `json:"audio_tracks,omitempty"`
+		Subtitles    []TrackInfo `json:"subtitles,omitempty"`
 	}
 
 	var videos []VideoInfo
@@ -137,7 +156,18 @@ func handleGetVideos(w http.ResponseWriter, r *http.Request) {
 			info.Status = mapping.Status
 			info.TranscodeDir = mapping.TranscodeDir
 			if mapping.Status == "completed" {
-				info.StreamURL = fmt.Sprintf("/hls/%s/master.m3u8", mapping.TranscodeDir)
+				// The on-demand HLS handler keys sessions by the original
+				// filename (it stats videos/<name> directly), not by the
+				// extension-stripped TranscodeDir used for eager DASH output.
+				info.StreamURL = fmt.Sprintf("/hls/%s/master.m3u8", mapping.OriginalName)
+				info.DashURL = dashURL(mapping)
+				info.AudioTracks = mapping.AudioTracks
+				info.Subtitles = mapping.Subtitles
+			}
+			if mapping.Status == "processing" {
+				if st, ok := transcodeQueue.status(name); ok {
+					info.Progress = &st
+				}
 			}
 		}
 
@@ -166,6 +196,19 @@ func handleTranscode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	formatName := r.URL.Query().Get("format")
+	formats, err := formatsFor(formatName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if formatName == "" || formatName == "both" {
+		// HLS is served on-demand by handleHLS and needs no eager job, so
+		// formatsFor only ever queues a DASH packager for "" and "both";
+		// normalize the stored Format to match what was actually produced.
+		formatName = "dash"
+	}
+
 	// Check if video exists
 	videoPath := filepath.Join("videos", videoName)
 	if _, err := os.Stat(videoPath); os.IsNotExist(err) {
@@ -182,7 +225,7 @@ func handleTranscode(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{
 			"message":       "Video already transcoded",
 			"transcode_dir": mapping.TranscodeDir,
-			"stream_url":    fmt.Sprintf("/hls/%s/master.m3u8", mapping.TranscodeDir),
+			"stream_url":    fmt.Sprintf("/hls/%s/master.m3u8", mapping.OriginalName),
 		})
 		return
 	}
@@ -198,33 +241,69 @@ func handleTranscode(w http.ResponseWriter, r *http.Request) {
 	// Create transcode directory
 	transcodeDir := strings.TrimSuffix(videoName, filepath.Ext(videoName))
 	transcodeFullPath := filepath.Join("transcoded", transcodeDir)
-	os.MkdirAll(transcodeFullPath, 0755)
 
-	// Create mapping
+	// Skip re-transcoding if an upload with the same content hash has
+	// already completed under a different name.
+	var hash string
+	if mapping != nil {
+		hash = mapping.Hash
+	}
+
 	state.mu.Lock()
+	if dupe := dedupeMapping(hash, videoName); dupe != nil {
+		state.mappings[videoName] = &VideoMapping{
+			OriginalName: videoName,
+			TranscodeDir: dupe.TranscodeDir,
+			Status:       "completed",
+			Format:       dupe.Format,
+			Hash:         dupe.Hash,
+		}
+		state.save()
+		state.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":       "Video already transcoded (dedupe match)",
+			"transcode_dir": dupe.TranscodeDir,
+			"stream_url":    fmt.Sprintf("/hls/%s/master.m3u8", videoName),
+		})
+		return
+	}
+	os.MkdirAll(transcodeFullPath, 0755)
 	state.mappings[videoName] = &VideoMapping{
 		OriginalName: videoName,
 		TranscodeDir: transcodeDir,
 		Status:       "processing",
+		Format:       formatName,
 	}
 	state.save()
 	state.mu.Unlock()
 
-	// Start transcoding in background
-	go transcode(videoPath, transcodeFullPath, videoName)
+	// Hand off to the bounded worker pool instead of spawning an
+	// unbounded goroutine per request.
+	position := transcodeQueue.enqueue(&transcodeJob{
+		videoName: videoName,
+		videoPath: videoPath,
+		outputDir: transcodeFullPath,
+		formats:   formats,
+	})
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":       "Transcoding started",
-		"transcode_dir": transcodeDir,
-		"status":        "processing",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Transcoding queued",
+		"transcode_dir":  transcodeDir,
+		"status":         "processing",
+		"queue_position": position,
 	})
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
+	videoName := strings.TrimPrefix(r.URL.Path, "/api/status/")
+	if strings.HasSuffix(videoName, "/stream") {
+		handleStatusStream(w, r, strings.TrimSuffix(videoName, "/stream"))
+		return
+	}
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
-	videoName := strings.TrimPrefix(r.URL.Path, "/api/status/")
 	if videoName == "" {
 		http.Error(w, "Missing video name", http.StatusBadRequest)
 		return
@@ -239,57 +318,36 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := map[string]string{
+	response := map[string]interface{}{
 		"video":         mapping.OriginalName,
 		"transcode_dir": mapping.TranscodeDir,
 		"status":        mapping.Status,
 	}
 
 	if mapping.Status == "completed" {
-		response["stream_url"] = fmt.Sprintf("/hls/%s/master.m3u8", mapping.TranscodeDir)
+		response["stream_url"] = fmt.Sprintf("/hls/%s/master.m3u8", mapping.OriginalName)
+		if d := dashURL(mapping); d != "" {
+			response["dash_url"] = d
+		}
 	}
 
-	json.NewEncoder(w).Encode(response)
-}
-
-func transcode(videoPath, outputDir, videoName string) {
-	log.Printf("Starting transcode for: %s", videoName)
-
-	// Build ffmpeg command
-	cmd := exec.Command("ffmpeg",
-		"-i", videoPath,
-		"-filter:v:0", "scale=w=854:h=480", "-c:v:0", "libx264", "-b:v:0", "300k", "-g", "60",
-		"-filter:v:1", "scale=w=1280:h=720", "-c:v:1", "libx264", "-b:v:1", "1500k", "-g", "60",
-		"-filter:v:2", "scale=w=1920:h=1080", "-c:v:2", "libx264", "-b:v:2", "3000k", "-g", "60",
-		"-map", "0:v", "-map", "0:a", "-map", "0:v", "-map", "0:a", "-map", "0:v", "-map", "0:a",
-		"-c:a:0", "aac", "-b:a:0", "64k",
-		"-c:a:1", "aac", "-b:a:1", "96k",
-		"-c:a:2", "aac", "-b:a:2", "128k",
-		"-f", "hls",
-		"-hls_time", "5",
-		"-hls_list_size", "0",
-		"-hls_flags", "independent_segments",
-		"-var_stream_map", "v:0,a:0 v:1,a:1 v:2,a:2",
-		"-master_pl_name", "master.m3u8",
-		"-hls_segment_filename", filepath.Join(outputDir, "stream_%v/chunk%05d.ts"),
-		filepath.Join(outputDir, "stream_%v/stream.m3u8"),
-	)
-
-	// Run command
-	output, err := cmd.CombinedOutput()
-
-	state.mu.Lock()
-	defer state.mu.Unlock()
+	if len(mapping.Ladder) > 0 {
+		response["ladder"] = mapping.Ladder
+	}
+	if len(mapping.AudioTracks) > 0 {
+		response["audio_tracks"] = mapping.AudioTracks
+	}
+	if len(mapping.Subtitles) > 0 {
+		response["subtitles"] = mapping.Subtitles
+	}
 
-	if err != nil {
-		log.Printf("Transcode failed for %s: %v\n%s", videoName, err, string(output))
-		state.mappings[videoName].Status = "failed"
-	} else {
-		log.Printf("Transcode completed for: %s", videoName)
-		state.mappings[videoName].Status = "completed"
+	if mapping.Status == "processing" {
+		if st, ok := transcodeQueue.status(videoName); ok {
+			response["progress"] = st
+		}
 	}
 
-	state.save()
+	json.NewEncoder(w).Encode(response)
 }
 
 func (s *TranscodeState) load() error {
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobStatus is the live state of one queued/running transcode job, updated
+// as the worker parses ffmpeg's `-progress pipe:1` output.
+type jobStatus struct {
+	QueuePosition int     `json:"queue_position,omitempty"`
+	Progress      float64 `json:"progress"` // 0..1
+	Speed         string  `json:"speed,omitempty"`
+	FPS           float64 `json:"fps,omitempty"`
+	ETA           string  `json:"eta,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// transcodeJob is one unit of work submitted by handleTranscode.
+type transcodeJob struct {
+	videoName string
+	videoPath string
+	outputDir string
+	formats   []PackagingFormat
+}
+
+// TranscodeQueue is a bounded worker pool that replaces the old
+// fire-and-forget "go transcode(...)" per request: jobs queue up on a FIFO
+// channel and are picked up by a fixed number of workers, with live
+// progress tracked per video.
+type TranscodeQueue struct {
+	jobs chan *transcodeJob
+
+	mu       sync.Mutex
+	statuses map[string]*jobStatus
+}
+
+func newTranscodeQueue(workers int) *TranscodeQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &TranscodeQueue{
+		jobs:     make(chan *transcodeJob, 256),
+		statuses: make(map[string]*jobStatus),
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// defaultQueueWorkers follows the runtime.NumCPU()/2 sizing called out for
+// the queue, with a floor of 1 for small machines.
+func defaultQueueWorkers() int {
+	if n := runtime.NumCPU() / 2; n > 0 {
+		return n
+	}
+	return 1
+}
+
+var transcodeQueue = newTranscodeQueue(defaultQueueWorkers())
+
+// enqueue queues a job and returns its position in the FIFO (1 = next up).
+func (q *TranscodeQueue) enqueue(job *transcodeJob) int {
+	q.mu.Lock()
+	position := len(q.jobs) + 1
+	q.statuses[job.videoName] = &jobStatus{QueuePosition: position}
+	q.mu.Unlock()
+
+	q.jobs <- job
+	return position
+}
+
+func (q *TranscodeQueue) status(video string) (jobStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.statuses[video]
+	if !ok {
+		return jobStatus{}, false
+	}
+	return *s, true
+}
+
+func (q *TranscodeQueue) update(video string, fn func(*jobStatus)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.statuses[video]
+	if !ok {
+		s = &jobStatus{}
+		q.statuses[video] = s
+	}
+	fn(s)
+}
+
+func (q *TranscodeQueue) worker() {
+	for job := range q.jobs {
+		q.runJob(job)
+	}
+}
+
+func (q *TranscodeQueue) runJob(job *transcodeJob) {
+	log.Printf("Starting transcode for: %s", job.videoName)
+	q.update(job.videoName, func(s *jobStatus) { s.QueuePosition = 0 })
+
+	info, err := probe(job.videoPath)
+	if err != nil {
+		q.fail(job.videoName, fmt.Errorf("probe failed: %w", err))
+		return
+	}
+	ladder := chooseLadder(info)
+
+	state.mu.Lock()
+	if m, ok := state.mappings[job.videoName]; ok {
+		m.Ladder = ladder
+		m.AudioTracks = info.AudioTracks
+		m.Subtitles = info.Subtitles
+		state.save()
+	}
+	state.mu.Unlock()
+
+	for _, format := range job.formats {
+		args := append([]string{"-i", job.videoPath}, buildLadderArgs(ladder, info.AudioTracks, info.Subtitles, format.Name())...)
+		args = append(args, format.OutputArgs(job.outputDir, ladder, info.AudioTracks, info.Subtitles)...)
+		args = append(args, "-progress", "pipe:1", "-nostats")
+
+		cmd := exec.Command("ffmpeg", args...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			q.fail(job.videoName, err)
+			return
+		}
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+
+		if err := cmd.Start(); err != nil {
+			q.fail(job.videoName, err)
+			return
+		}
+
+		q.watchProgress(job.videoName, stdout, info.Duration)
+
+		if err := cmd.Wait(); err != nil {
+			log.Printf("Transcode (%s) failed for %s: %v\n%s", format.Name(), job.videoName, err, stderr.String())
+			q.fail(job.videoName, err)
+			return
+		}
+	}
+
+	log.Printf("Transcode completed for: %s", job.videoName)
+	state.mu.Lock()
+	if m, ok := state.mappings[job.videoName]; ok {
+		m.Status = "completed"
+		state.save()
+	}
+	state.mu.Unlock()
+
+	q.update(job.videoName, func(s *jobStatus) { s.Progress = 1 })
+}
+
+// fail records a job's failure on its mapping, if the mapping still exists —
+// DELETE /api/videos/<name> can remove it out from under a running job.
+func (q *TranscodeQueue) fail(video string, err error) {
+	state.mu.Lock()
+	if m, ok := state.mappings[video]; ok {
+		m.Status = "failed"
+		state.save()
+	}
+	state.mu.Unlock()
+
+	q.update(video, func(s *jobStatus) { s.Error = err.Error() })
+}
+
+// watchProgress parses ffmpeg's `-progress pipe:1` key=value stream,
+// updating the job's status after every "progress=continue/end" frame.
+func (q *TranscodeQueue) watchProgress(video string, stdout io.Reader, duration float64) {
+	scanner := bufio.NewScanner(stdout)
+	frame := map[string]string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		frame[key] = value
+
+		if key != "progress" {
+			continue
+		}
+
+		q.update(video, func(s *jobStatus) {
+			if fps, err := strconv.ParseFloat(frame["fps"], 64); err == nil {
+				s.FPS = fps
+			}
+			s.Speed = frame["speed"]
+
+			if outMicros, err := strconv.ParseInt(frame["out_time_ms"], 10, 64); err == nil && duration > 0 {
+				elapsed := float64(outMicros) / 1e6
+				progress := elapsed / duration
+				if progress > 1 {
+					progress = 1
+				}
+				s.Progress = progress
+
+				if speed, err := strconv.ParseFloat(strings.TrimSuffix(frame["speed"], "x"), 64); err == nil && speed > 0 {
+					remaining := (duration - elapsed) / speed
+					if remaining < 0 {
+						remaining = 0
+					}
+					s.ETA = fmt.Sprintf("%.0fs", remaining)
+				}
+			}
+		})
+
+		frame = map[string]string{}
+	}
+}
+
+// audioBitrateLadder mirrors the old fixed 64k/96k/128k tiers, extended
+// upward for ladders/audio tracks with more than three entries.
+var audioBitrateLadder = []string{"64k", "96k", "128k", "160k", "192k", "224k", "256k"}
+
+func audioBitrateFor(index int) string {
+	if index < len(audioBitrateLadder) {
+		return audioBitrateLadder[index]
+	}
+	return audioBitrateLadder[len(audioBitrateLadder)-1]
+}
+
+// buildLadderArgs returns the ffmpeg arguments shared by every packaging
+// format for a per-title ladder: the per-rendition video scale/codec
+// filters plus every audio track, each mapped as its own output stream so
+// HLS can expose them as alternate renditions rather than baking one audio
+// track into each video variant. Subtitle tracks are only mapped for
+// formatName == "hls": dashFormat's adaptation sets declare just v/a
+// streams, so muxing a webvtt subtitle map into a DASH output fails.
+func buildLadderArgs(ladder []variantSpec, audioTracks, subtitles []TrackInfo, formatName string) []string {
+	var args []string
+	for i, v := range ladder {
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), fmt.Sprintf("scale=w=%d:h=%d", v.Width, v.Height),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), v.Bitrate,
+			"-g", "60",
+		)
+	}
+	for range ladder {
+		args = append(args, "-map", "0:v")
+	}
+	if formatName != "hls" {
+		subtitles = nil
+	}
+	args = append(args, trackMapArgs(audioTracks, subtitles)...)
+	return args
+}
+
+// handleStatusStream implements GET /api/status/<video>/stream, an SSE feed
+// of JSON status frames that closes once the job reaches a terminal state.
+func handleStatusStream(w http.ResponseWriter, r *http.Request, videoName string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			state.mu.RLock()
+			mapping, exists := state.mappings[videoName]
+			state.mu.RUnlock()
+			if !exists {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", `{"error":"video not found"}`)
+				flusher.Flush()
+				return
+			}
+
+			st, _ := transcodeQueue.status(videoName)
+			payload := map[string]interface{}{
+				"status":   mapping.Status,
+				"progress": st,
+			}
+			data, _ := json.Marshal(payload)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+
+			if mapping.Status == "completed" || mapping.Status == "failed" {
+				return
+			}
+		}
+	}
+}
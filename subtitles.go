@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TrackInfo describes one additional audio or subtitle stream carried
+// alongside the main video ladder, surfaced to players via /api/status and
+// /api/videos so they can present language pickers.
+type TrackInfo struct {
+	Index    int    `json:"index"`
+	Language string `json:"language,omitempty"`
+}
+
+// languageName is a tiny, deliberately partial map from ISO 639-ish tags to
+// display names for the HLS #EXT-X-MEDIA NAME attribute. Unknown codes fall
+// back to the tag itself so playback isn't blocked on an exhaustive list.
+var languageName = map[string]string{
+	"eng": "English",
+	"spa": "Spanish",
+	"fre": "French",
+	"fra": "French",
+	"ger": "German",
+	"deu": "German",
+	"jpn": "Japanese",
+}
+
+func displayLanguage(tag string) string {
+	if tag == "" {
+		return "Unknown"
+	}
+	if name, ok := languageName[tag]; ok {
+		return name
+	}
+	return tag
+}
+
+// trackMapArgs builds the -map/-c:a/-c:s arguments that pull every audio
+// and subtitle track out of the source alongside the video ladder: each
+// audio track is re-encoded to AAC, each subtitle track converted to
+// WebVTT so it can ride inside HLS.
+func trackMapArgs(audioTracks, subtitles []TrackInfo) []string {
+	var args []string
+	for _, t := range audioTracks {
+		args = append(args,
+			"-map", fmt.Sprintf("0:a:%d", t.Index),
+			fmt.Sprintf("-c:a:%d", t.Index), "aac",
+			fmt.Sprintf("-b:a:%d", t.Index), audioBitrateFor(t.Index),
+		)
+		if t.Language != "" {
+			args = append(args, fmt.Sprintf("-metadata:s:a:%d", t.Index), "language="+t.Language)
+		}
+	}
+	for _, t := range subtitles {
+		args = append(args,
+			"-map", fmt.Sprintf("0:s:%d", t.Index),
+			fmt.Sprintf("-c:s:%d", t.Index), "webvtt",
+		)
+		if t.Language != "" {
+			args = append(args, fmt.Sprintf("-metadata:s:s:%d", t.Index), "language="+t.Language)
+		}
+	}
+	return args
+}
+
+// hlsVarStreamMap builds ffmpeg's -var_stream_map value for a video ladder
+// plus its alternate audio/subtitle renditions: every video rendition
+// joins the "aud" audio group and, if present, the "subs" subtitle group;
+// each audio/subtitle track gets its own group entry carrying the
+// language tag so players can offer a language picker.
+func hlsVarStreamMap(ladder []variantSpec, audioTracks, subtitles []TrackInfo) string {
+	var entries []string
+
+	for i := range ladder {
+		entry := fmt.Sprintf("v:%d", i)
+		if len(audioTracks) > 0 {
+			entry += ",agroup:aud"
+		}
+		if len(subtitles) > 0 {
+			entry += ",sgroup:subs"
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, t := range audioTracks {
+		entries = append(entries, fmt.Sprintf("a:%d,agroup:aud%s,name:%s", t.Index, languageToken(t.Language), displayLanguage(t.Language)))
+	}
+
+	for _, t := range subtitles {
+		entries = append(entries, fmt.Sprintf("s:%d,sgroup:subs%s,name:%s", t.Index, languageToken(t.Language), displayLanguage(t.Language)))
+	}
+
+	return strings.Join(entries, " ")
+}
+
+// languageToken returns the ",language:<tag>" fragment for a var_stream_map
+// entry, or "" when the source stream carries no language tag — ffmpeg
+// rejects an empty language: value outright.
+func languageToken(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	return ",language:" + tag
+}
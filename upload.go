@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// uploadsDir holds in-progress chunked uploads until they're complete, at
+// which point they're renamed into videos/ atomically.
+const uploadsDir = "videos/.uploads"
+
+var contentRangeRe = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// uploadSession tracks one in-flight resumable upload. The SHA-256 is
+// computed incrementally as chunks arrive, so chunks must be sent in order.
+// mu serializes the file/hasher/received updates below across concurrent
+// chunk POSTs for the same name.
+type uploadSession struct {
+	mu       sync.Mutex
+	file     *os.File
+	hasher   hash.Hash
+	received int64
+	total    int64
+}
+
+type uploadState struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+var uploads = &uploadState{sessions: make(map[string]*uploadSession)}
+
+// adminToken gates the admin-authenticated upload route (/api/admin/upload).
+// Left empty (the default), that route is open, matching the rest of this API.
+var adminToken = envOr("ADMIN_TOKEN", "")
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" && r.Header.Get("X-Admin-Token") != adminToken {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleUpload implements chunked/resumable uploads via Content-Range:
+//
+//	POST /api/upload?name=<file>
+//	Content-Range: bytes <start>-<end>/<total>
+//
+// Partial data is buffered in videos/.uploads/<name>.part and the file is
+// renamed into videos/ once the last chunk lands. A SHA-256 of the
+// reassembled file is recorded on the video's mapping for dedupe.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		http.Error(w, "Invalid 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		http.Error(w, "Could not prepare uploads directory", http.StatusInternalServerError)
+		return
+	}
+	partPath := filepath.Join(uploadsDir, name+".part")
+
+	uploads.mu.Lock()
+	session, ok := uploads.sessions[name]
+	if !ok {
+		if start != 0 {
+			uploads.mu.Unlock()
+			http.Error(w, "Upload must start at offset 0", http.StatusBadRequest)
+			return
+		}
+		f, err := os.Create(partPath)
+		if err != nil {
+			uploads.mu.Unlock()
+			http.Error(w, "Could not create upload file", http.StatusInternalServerError)
+			return
+		}
+		session = &uploadSession{file: f, hasher: sha256.New(), total: total}
+		uploads.sessions[name] = session
+	}
+	uploads.mu.Unlock()
+
+	// Serialize this session's writes: two chunks for the same name can
+	// otherwise race on session.received and the io.MultiWriter below,
+	// corrupting the reassembled file and its hash.
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.received != start {
+		http.Error(w, fmt.Sprintf("Expected chunk at offset %d, got %d", session.received, start), http.StatusBadRequest)
+		return
+	}
+
+	written, err := io.Copy(io.MultiWriter(session.file, session.hasher), r.Body)
+	if err != nil {
+		http.Error(w, "Failed to write chunk", http.StatusInternalServerError)
+		return
+	}
+	session.received += written
+
+	if end+1 < total {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "partial",
+			"received": session.received,
+			"total":    total,
+		})
+		return
+	}
+
+	// Last chunk: finalize the upload.
+	session.file.Close()
+	sum := hex.EncodeToString(session.hasher.Sum(nil))
+
+	uploads.mu.Lock()
+	delete(uploads.sessions, name)
+	uploads.mu.Unlock()
+
+	finalPath := filepath.Join("videos", name)
+	if err := os.Rename(partPath, finalPath); err != nil {
+		http.Error(w, "Could not finalize upload", http.StatusInternalServerError)
+		return
+	}
+
+	state.mu.Lock()
+	if existing, ok := state.mappings[name]; ok {
+		existing.Hash = sum
+	} else {
+		state.mappings[name] = &VideoMapping{OriginalName: name, Status: "uploaded", Hash: sum}
+	}
+	state.save()
+	state.mu.Unlock()
+
+	log.Printf("Upload completed for %s (sha256=%s)", name, sum)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "completed",
+		"name":   name,
+		"hash":   sum,
+	})
+}
+
+func parseContentRange(header string) (start, end, total int64, err error) {
+	m := contentRangeRe.FindStringSubmatch(header)
+	if m == nil {
+		return 0, 0, 0, fmt.Errorf("missing or malformed Content-Range header")
+	}
+	start, _ = strconv.ParseInt(m[1], 10, 64)
+	end, _ = strconv.ParseInt(m[2], 10, 64)
+	total, _ = strconv.ParseInt(m[3], 10, 64)
+	return start, end, total, nil
+}
+
+// dedupeMapping finds a completed mapping sharing hash (other than self)
+// so handleTranscode can skip re-transcoding a file that's already been
+// processed under a different name.
+func dedupeMapping(hash, self string) *VideoMapping {
+	if hash == "" {
+		return nil
+	}
+	for name, m := range state.mappings {
+		if name != self && m.Hash == hash && m.Status == "completed" {
+			return m
+		}
+	}
+	return nil
+}
+
+// handleDeleteVideo implements DELETE /api/videos/<name>, removing both the
+// source file and its transcoded output plus the mapping.
+func handleDeleteVideo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := filepath.Base(r.URL.Path)
+	if name == "" || name == "." || name == "/" {
+		http.Error(w, "Missing video name", http.StatusBadRequest)
+		return
+	}
+
+	state.mu.Lock()
+	mapping, exists := state.mappings[name]
+	if exists {
+		delete(state.mappings, name)
+		state.save()
+	}
+	state.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	}
+
+	os.Remove(filepath.Join("videos", name))
+	if mapping.TranscodeDir != "" {
+		os.RemoveAll(filepath.Join("transcoded", mapping.TranscodeDir))
+	}
+	// On-demand HLS sessions write under transcoded/<name>/<variant>.
+	os.RemoveAll(filepath.Join("transcoded", name))
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Video deleted"})
+}